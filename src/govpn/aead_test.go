@@ -0,0 +1,120 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKey(b byte) *[SSize]byte {
+	var key [SSize]byte
+	for i := range key {
+		key[i] = b
+	}
+	return &key
+}
+
+// TestAEADInterop checks that every offered suite's Seal/Open round
+// trips a plaintext unchanged, and that a ciphertext sealed under one
+// suite does not authenticate under another -- the two constructions
+// must not be interoperable with each other's wire format.
+func TestAEADInterop(t *testing.T) {
+	plaintext := []byte("hello, govpn")
+	key := testKey(1)
+	sealed := make(map[CipherSuite][]byte)
+	for _, suite := range CipherSuitesOffered {
+		aead, err := NewAEAD(suite, key)
+		if err != nil {
+			t.Fatalf("%s: NewAEAD: %s", suite, err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		ct := aead.Seal(nil, nonce, plaintext, nil)
+		sealed[suite] = ct
+		pt, err := aead.Open(nil, nonce, ct, nil)
+		if err != nil {
+			t.Fatalf("%s: Open: %s", suite, err)
+		}
+		if !bytes.Equal(pt, plaintext) {
+			t.Fatalf("%s: round-tripped plaintext mismatch: %q != %q", suite, pt, plaintext)
+		}
+	}
+	for _, suite := range CipherSuitesOffered {
+		aead, err := NewAEAD(suite, key)
+		if err != nil {
+			t.Fatalf("%s: NewAEAD: %s", suite, err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		for other, ct := range sealed {
+			if other == suite {
+				continue
+			}
+			if _, err := aead.Open(nil, nonce, ct, nil); err == nil {
+				t.Fatalf("%s: Open succeeded on a %s ciphertext", suite, other)
+			}
+		}
+	}
+}
+
+// TestNewAEADRejectsUnsupportedSuite checks that NewAEAD refuses a
+// CipherSuite value this build has never heard of instead of
+// silently falling back to one it does support.
+func TestNewAEADRejectsUnsupportedSuite(t *testing.T) {
+	_, err := NewAEAD(CipherSuite(99), testKey(1))
+	if err != ErrUnsupportedCipherSuite {
+		t.Fatalf("got %v, want ErrUnsupportedCipherSuite", err)
+	}
+}
+
+// TestCipherSuiteNegotiatePrefersOurs checks that negotiation picks
+// the most preferred suite common to both sides, in the order ours
+// lists it, not theirs.
+func TestCipherSuiteNegotiatePrefersOurs(t *testing.T) {
+	theirs := []CipherSuite{CipherSalsa20Poly1305, CipherChaCha20Poly1305}
+	suite, err := CipherSuiteNegotiate(CipherSuitesOffered, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != CipherChaCha20Poly1305 {
+		t.Fatalf("got %s, want %s", suite, CipherChaCha20Poly1305)
+	}
+}
+
+// TestCipherSuiteNegotiateFallsBackToSalsa checks that talking to an
+// older peer which only knows CipherSalsa20Poly1305 still succeeds.
+func TestCipherSuiteNegotiateFallsBackToSalsa(t *testing.T) {
+	theirs := []CipherSuite{CipherSalsa20Poly1305}
+	suite, err := CipherSuiteNegotiate(CipherSuitesOffered, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != CipherSalsa20Poly1305 {
+		t.Fatalf("got %s, want %s", suite, CipherSalsa20Poly1305)
+	}
+}
+
+// TestCipherSuiteNegotiateNoCommonSuite checks that negotiation is
+// rejected, rather than guessing, when the two sides have nothing in
+// common.
+func TestCipherSuiteNegotiateNoCommonSuite(t *testing.T) {
+	_, err := CipherSuiteNegotiate(CipherSuitesOffered, []CipherSuite{CipherSuite(99)})
+	if err != ErrUnsupportedCipherSuite {
+		t.Fatalf("got %v, want ErrUnsupportedCipherSuite", err)
+	}
+}
@@ -0,0 +1,356 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// HandshakeTimeout is how long a client may sit mid-handshake
+	// before Listener gives up on it and frees its slot.
+	HandshakeTimeout = 30 * time.Second
+	// MaxPendingClients bounds how many source addresses Listener
+	// will track at once (handshaking or established), so a
+	// spoofed-source flood cannot grow its client map without
+	// bound.
+	MaxPendingClients = 4096
+	// handshakeSweepInterval is how often Listener checks for
+	// stale, peer-less clients to evict.
+	handshakeSweepInterval = 5 * time.Second
+	// clientInboxSize is how many not-yet-processed datagrams a
+	// single client's goroutine may have queued up. Past this, newer
+	// datagrams from that client are dropped rather than blocking
+	// Listen's single read loop.
+	clientInboxSize = 64
+)
+
+// listenerClient is what Listener keeps per source address: either a
+// handshake still in progress, or the Peer it produced. Both share a
+// single slot so that StatsProcessor can be handed a stable **Peer
+// that flips from nil to non-nil (and back, on rehandshake) without
+// the caller's map entry ever moving. Every client is driven by its
+// own goroutine reading off inbox, so one stuck peer cannot stall
+// another's handshake or traffic. done is closed exactly once, by
+// whichever eviction path removes the client from Listener.clients,
+// telling that goroutine to stop; inbox itself is never closed, since
+// dispatch may still be mid-send to it when eviction happens.
+type listenerClient struct {
+	addr      string
+	handshake *Handshake
+	peer      *Peer
+	started   time.Time
+	inbox     chan []byte
+	done      chan struct{}
+}
+
+// Listener owns a single bound UDP socket and demultiplexes inbound
+// datagrams across many simultaneous clients, replacing the
+// one-to-one assumption that govpn-client's dummy KnownPeers entry
+// makes. Unknown source addresses are matched against IDsCache on
+// their encrypted nonce prefix to learn which PeerConf to handshake
+// with; once a handshake completes its Peer is driven and rekeyed
+// independently of every other client, and all of them write
+// decrypted frames to the same shared TAP.
+type Listener struct {
+	conn *net.UDPConn
+	tap  io.Writer
+
+	// ConfByID resolves the PeerConf to hand to a new handshake,
+	// once IDsCache has identified who a never-seen-before source
+	// address claims to be. It returns nil for an unknown id.
+	ConfByID func(id *PeerId) *PeerConf
+
+	mu      sync.RWMutex
+	clients map[string]*listenerClient
+
+	stop chan struct{}
+}
+
+// NewListener binds a UDP socket at bindAddr and returns a Listener
+// ready to have its Listen goroutine started. Decrypted frames from
+// every peer it accepts are written to tap. A background goroutine
+// sweeps away clients whose handshake has stalled past
+// HandshakeTimeout until Close is called.
+func NewListener(bindAddr string, tap io.Writer, confByID func(id *PeerId) *PeerConf) (*Listener, error) {
+	addr, err := net.ResolveUDPAddr("udp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		conn:     conn,
+		tap:      tap,
+		ConfByID: confByID,
+		clients:  make(map[string]*listenerClient),
+		stop:     make(chan struct{}),
+	}
+	go l.sweepStaleHandshakes()
+	return l, nil
+}
+
+// KnownPeers builds a KnownPeers snapshot suitable for
+// StatsProcessor, one entry per source address currently known to
+// the Listener (handshaking or established).
+func (l *Listener) KnownPeers() KnownPeers {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	known := make(KnownPeers, len(l.clients))
+	for addr, c := range l.clients {
+		c := c
+		known[addr] = &c.peer
+	}
+	return known
+}
+
+// Listen reads datagrams off the bound socket until it errors out
+// (which happens on Close), dispatching each to the owning client's
+// goroutine. It is meant to be run in its own goroutine.
+func (l *Listener) Listen() error {
+	buf := make([]byte, MTU)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		l.dispatch(addr, data)
+	}
+}
+
+// Close shuts down the bound socket, causing Listen to return, evicts
+// every tracked client so their serve goroutines stop, and stops the
+// handshake-sweeping goroutine.
+func (l *Listener) Close() error {
+	close(l.stop)
+	l.mu.Lock()
+	for addr := range l.clients {
+		l.evictLocked(addr)
+	}
+	l.mu.Unlock()
+	return l.conn.Close()
+}
+
+// dispatch hands data to the goroutine driving addr's client,
+// starting one (and, for a never-seen source, a fresh handshake) if
+// none exists yet. Each client's own goroutine serializes its
+// packets so nonce/replay state stays safe without a global lock,
+// while distinct clients make progress concurrently -- a slow peer
+// can only ever stall itself.
+//
+// A never-seen-before source only gets a placeholder client and its
+// inbox inserted while l.mu is held; identity resolution and the
+// handshake itself (IDsCache.Find, ConfByID, HandshakeStart -- the
+// latter doing a real network write) run afterwards in setupClient,
+// off the lock, so a flood of new/spoofed first-packets cannot stall
+// lookups for every already-established peer.
+func (l *Listener) dispatch(addr *net.UDPAddr, data []byte) {
+	addrStr := addr.String()
+
+	l.mu.Lock()
+	c, exists := l.clients[addrStr]
+	if !exists {
+		if len(l.clients) >= MaxPendingClients {
+			l.mu.Unlock()
+			log.Println("govpn: too many clients already tracked, dropping", addrStr)
+			return
+		}
+		c = &listenerClient{
+			addr:    addrStr,
+			started: time.Now(),
+			inbox:   make(chan []byte, clientInboxSize),
+			done:    make(chan struct{}),
+		}
+		l.clients[addrStr] = c
+		l.mu.Unlock()
+		go l.setupClient(c, data)
+		return
+	}
+	l.mu.Unlock()
+
+	select {
+	case c.inbox <- data:
+	default:
+		log.Println("govpn: backlog full, dropping datagram from", addrStr)
+	}
+}
+
+// setupClient resolves a never-seen-before source's identity and
+// starts its handshake, none of which happens while any lock is held,
+// then feeds it first (the datagram that caused dispatch to create c)
+// before handing c off to serve for everything after. On failure it
+// evicts the placeholder c it was given so a later datagram from the
+// same source starts over cleanly.
+func (l *Listener) setupClient(c *listenerClient, first []byte) {
+	id := IDsCache.Find(first)
+	if id == nil {
+		log.Println("govpn: unknown identity from", c.addr)
+		l.evict(c.addr)
+		return
+	}
+	conf := l.ConfByID(id)
+	if conf == nil {
+		log.Println("govpn: no configuration for", id, "from", c.addr)
+		l.evict(c.addr)
+		return
+	}
+	handshake := HandshakeStart(c.addr, l.conn, conf)
+
+	l.mu.Lock()
+	if _, exists := l.clients[c.addr]; !exists {
+		// Evicted (e.g. by the stale-handshake sweep) while the
+		// handshake was being started above.
+		l.mu.Unlock()
+		return
+	}
+	c.handshake = handshake
+	l.mu.Unlock()
+
+	l.processOne(c, first)
+	l.serve(c)
+}
+
+// serve drives a single client's handshake and then its Peer,
+// reading off c.inbox until the client is evicted, which closes
+// c.done. A panic while processing one malformed datagram is
+// contained to this client instead of taking down every other one
+// sharing the Listener.
+func (l *Listener) serve(c *listenerClient) {
+	for {
+		select {
+		case data := <-c.inbox:
+			l.processOne(c, data)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (l *Listener) processOne(c *listenerClient, data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("govpn: recovered from panic processing", c.addr, ":", r)
+			l.evict(c.addr)
+		}
+	}()
+
+	if c.peer == nil {
+		peer := c.handshake.Server(data)
+		if peer == nil {
+			return
+		}
+		c.handshake.Zero()
+		l.mu.Lock()
+		c.handshake = nil
+		c.peer = peer
+		l.mu.Unlock()
+		return
+	}
+
+	ready := make(chan struct{}, 1)
+	if c.peer.PktProcess(data, l.tap, ready) {
+		l.rekeyIfDue(c)
+	}
+}
+
+// rekeyIfDue restarts c's handshake once its Peer has pushed
+// MaxBytesPerKey bytes, mirroring the rehandshake govpn-client does
+// in its own main loop, but scoped to a single client instead of the
+// whole process. Like setupClient, ConfByID and HandshakeStart run
+// without l.mu held, since c is only ever touched by its own serve
+// goroutine (this one) between the two lock sections below.
+func (l *Listener) rekeyIfDue(c *listenerClient) {
+	l.mu.Lock()
+	peer := c.peer
+	due := peer != nil && peer.BytesIn+peer.BytesOut > MaxBytesPerKey
+	l.mu.Unlock()
+	if !due {
+		return
+	}
+
+	conf := l.ConfByID(peer.Id)
+	peer.Zero()
+
+	l.mu.Lock()
+	c.peer = nil
+	c.started = time.Now()
+	if conf == nil {
+		l.evictLocked(c.addr)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	c.handshake = HandshakeStart(c.addr, l.conn, conf)
+}
+
+// evict drops addr's client from the map, if still present, and
+// signals its serve goroutine to stop.
+func (l *Listener) evict(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evictLocked(addr)
+}
+
+// evictLocked is evict's body, for callers that already hold l.mu. It
+// is safe to call on an addr no longer in the map (a no-op), so two
+// eviction paths racing for the same client never double-close done.
+func (l *Listener) evictLocked(addr string) {
+	c, exists := l.clients[addr]
+	if !exists {
+		return
+	}
+	delete(l.clients, addr)
+	close(c.done)
+}
+
+// sweepStaleHandshakes periodically evicts clients that have been
+// mid-handshake for longer than HandshakeTimeout, bounding how much
+// memory a flood of spoofed-source datagrams that never complete a
+// handshake can hold onto. It runs until Close is called.
+func (l *Listener) sweepStaleHandshakes() {
+	ticker := time.NewTicker(handshakeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.evictStaleHandshakes(time.Now())
+		}
+	}
+}
+
+func (l *Listener) evictStaleHandshakes(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for addr, c := range l.clients {
+		if c.peer == nil && now.Sub(c.started) > HandshakeTimeout {
+			l.evictLocked(addr)
+		}
+	}
+}
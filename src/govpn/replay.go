@@ -0,0 +1,109 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+// replayWindow is a fixed-size sliding anti-replay window, the same
+// algorithm IPsec AH/ESP use to spot duplicate or reordered
+// sequence numbers without keeping every seen nonce around. Bit 0
+// always tracks the highest nonce accepted so far; bit N tracks the
+// nonce N below it. It replaces GoVPN's former two-map duplicate
+// detector, which grew without bound under noise traffic and paid
+// for a map allocation on every rollover.
+type replayWindow struct {
+	size    uint64
+	seen    bool
+	highest uint64
+	bitmap  []uint64
+}
+
+// newReplayWindow allocates a window bits wide, rounded up to a
+// whole number of 64-bit words. bits <= 0 falls back to
+// ReplayWindowSize.
+func newReplayWindow(bits int) *replayWindow {
+	if bits <= 0 {
+		bits = ReplayWindowSize
+	}
+	return &replayWindow{
+		size:   uint64(bits),
+		bitmap: make([]uint64, (bits+63)/64),
+	}
+}
+
+// Accept reports whether nonce is new. If so, it is marked seen and
+// a later duplicate or replay of it will be rejected. tooOld is set
+// when nonce falls below the trailing edge of the window, which
+// callers should account for separately from a plain duplicate.
+func (w *replayWindow) Accept(nonce uint64) (accepted, tooOld bool) {
+	if !w.seen {
+		w.seen = true
+		w.highest = nonce
+		w.set(0)
+		return true, false
+	}
+	if nonce > w.highest {
+		w.shift(nonce - w.highest)
+		w.highest = nonce
+		w.set(0)
+		return true, false
+	}
+	delta := w.highest - nonce
+	if delta >= w.size {
+		return false, true
+	}
+	if w.test(delta) {
+		return false, false
+	}
+	w.set(delta)
+	return true, false
+}
+
+func (w *replayWindow) set(bit uint64) {
+	w.bitmap[bit/64] |= 1 << (bit % 64)
+}
+
+func (w *replayWindow) test(bit uint64) bool {
+	return w.bitmap[bit/64]&(1<<(bit%64)) != 0
+}
+
+// shift moves every tracked bit delta positions towards the
+// trailing (older) edge of the window, discarding anything that
+// falls off the end, and clears the positions vacated near bit 0.
+func (w *replayWindow) shift(delta uint64) {
+	if delta >= w.size {
+		for i := range w.bitmap {
+			w.bitmap[i] = 0
+		}
+		return
+	}
+	wordShift := int(delta / 64)
+	bitShift := uint(delta % 64)
+	for i := len(w.bitmap) - 1; i >= 0; i-- {
+		var word uint64
+		if i-wordShift >= 0 {
+			word = w.bitmap[i-wordShift]
+		}
+		if bitShift > 0 {
+			word <<= bitShift
+			if i-wordShift-1 >= 0 {
+				word |= w.bitmap[i-wordShift-1] >> (64 - bitShift)
+			}
+		}
+		w.bitmap[i] = word
+	}
+}
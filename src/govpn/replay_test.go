@@ -0,0 +1,92 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import "testing"
+
+// TestReplayWindowInOrder checks the common case: strictly increasing
+// nonces are all accepted, and re-presenting any of them is rejected
+// as a duplicate, not as too-old.
+func TestReplayWindowInOrder(t *testing.T) {
+	w := newReplayWindow(128)
+	for i := uint64(1); i <= 10; i++ {
+		if accepted, tooOld := w.Accept(i); !accepted || tooOld {
+			t.Fatalf("nonce %d: got accepted=%v tooOld=%v, want true,false", i, accepted, tooOld)
+		}
+	}
+	if accepted, tooOld := w.Accept(5); accepted || tooOld {
+		t.Fatalf("duplicate nonce 5: got accepted=%v tooOld=%v, want false,false", accepted, tooOld)
+	}
+}
+
+// TestReplayWindowReordering checks that nonces arriving out of order
+// but still inside the window are accepted exactly once each.
+func TestReplayWindowReordering(t *testing.T) {
+	w := newReplayWindow(128)
+	order := []uint64{5, 3, 4, 1, 2}
+	for _, n := range order {
+		if accepted, tooOld := w.Accept(n); !accepted || tooOld {
+			t.Fatalf("nonce %d: got accepted=%v tooOld=%v, want true,false", n, accepted, tooOld)
+		}
+	}
+	for _, n := range order {
+		if accepted, tooOld := w.Accept(n); accepted || tooOld {
+			t.Fatalf("replayed nonce %d: got accepted=%v tooOld=%v, want false,false", n, accepted, tooOld)
+		}
+	}
+}
+
+// TestReplayWindowGapLargerThanWindow checks that a nonce which jumps
+// far enough ahead to push every previously-seen nonce off the
+// trailing edge still gets accepted, and that those stale nonces are
+// then reported too-old rather than duplicate if seen again.
+func TestReplayWindowGapLargerThanWindow(t *testing.T) {
+	w := newReplayWindow(64)
+	if accepted, tooOld := w.Accept(1); !accepted || tooOld {
+		t.Fatalf("nonce 1: got accepted=%v tooOld=%v, want true,false", accepted, tooOld)
+	}
+	if accepted, tooOld := w.Accept(1000); !accepted || tooOld {
+		t.Fatalf("nonce 1000: got accepted=%v tooOld=%v, want true,false", accepted, tooOld)
+	}
+	if accepted, tooOld := w.Accept(1); accepted || !tooOld {
+		t.Fatalf("stale nonce 1: got accepted=%v tooOld=%v, want false,true", accepted, tooOld)
+	}
+}
+
+// TestReplayWindowEdges checks the bit tracking right at the trailing
+// edge of the window: the oldest nonce still inside the window is
+// accepted once and rejected as a duplicate afterwards, while
+// anything one position further back is too-old.
+func TestReplayWindowEdges(t *testing.T) {
+	w := newReplayWindow(64)
+	if accepted, tooOld := w.Accept(100); !accepted || tooOld {
+		t.Fatalf("nonce 100: got accepted=%v tooOld=%v, want true,false", accepted, tooOld)
+	}
+	oldestInWindow := uint64(100 - 63)
+	if accepted, tooOld := w.Accept(oldestInWindow); !accepted || tooOld {
+		t.Fatalf("oldest in-window nonce %d: got accepted=%v tooOld=%v, want true,false", oldestInWindow, accepted, tooOld)
+	}
+	if accepted, tooOld := w.Accept(oldestInWindow); accepted || tooOld {
+		t.Fatalf("duplicate of oldest in-window nonce %d: got accepted=%v tooOld=%v, want false,false", oldestInWindow, accepted, tooOld)
+	}
+	tooOldNonce := oldestInWindow - 1
+	if accepted, tooOld := w.Accept(tooOldNonce); accepted || !tooOld {
+		t.Fatalf("nonce %d one below the window: got accepted=%v tooOld=%v, want false,true", tooOldNonce, accepted, tooOld)
+	}
+}
@@ -23,14 +23,12 @@ import (
 	"io"
 	"time"
 
-	"golang.org/x/crypto/poly1305"
 	"golang.org/x/crypto/salsa20"
 	"golang.org/x/crypto/xtea"
 )
 
 const (
-	NonceSize       = 8
-	NonceBucketSize = 128
+	NonceSize = 8
 	// S20BS is Salsa20's internal blocksize in bytes
 	S20BS = 64
 	// Maximal amount of bytes transfered with single key (4 GiB)
@@ -39,6 +37,10 @@ const (
 	PktSizeSize = 2
 	// Heartbeat rate, relative to Timeout
 	TimeoutHeartbeat = 4
+	// ReplayWindowSize is the default width, in bits, of the
+	// sliding anti-replay window used to spot duplicate/out-of-order
+	// nonces, following the classic IPsec AH/ESP algorithm.
+	ReplayWindowSize = 1024
 )
 
 type Peer struct {
@@ -52,14 +54,13 @@ type Peer struct {
 	CPRCycle    time.Duration `json:"-"`
 
 	// Cryptography related
-	Key          *[SSize]byte `json:"-"`
-	NonceOur     uint64       `json:"-"`
-	NonceRecv    uint64       `json:"-"`
-	NonceCipher  *xtea.Cipher `json:"-"`
-	nonceBucket0 map[uint64]struct{}
-	nonceBucket1 map[uint64]struct{}
-	nonceFound   bool
-	nonceBucketN int32
+	Cipher      CipherSuite  `json:"-"`
+	Key         *[SSize]byte `json:"-"`
+	NonceOur    uint64       `json:"-"`
+	NonceRecv   uint64       `json:"-"`
+	NonceCipher *xtea.Cipher `json:"-"`
+	aead        AEAD
+	replay      *replayWindow
 
 	// Timers
 	Timeout       time.Duration `json:"-"`
@@ -70,11 +71,11 @@ type Peer struct {
 
 	// This variables are initialized only once to relief GC
 	buf       []byte
-	tag       *[poly1305.TagSize]byte
-	keyAuth   *[32]byte
+	out       []byte
 	nonceRecv uint64
 	frame     []byte
 	nonce     []byte
+	aeadNonce []byte
 	pktSize   uint64
 	size      int
 	now       time.Time
@@ -88,6 +89,7 @@ type Peer struct {
 	FramesOut       int
 	FramesUnauth    int
 	FramesDup       int
+	FramesTooOld    int
 	HeartbeatRecv   int
 	HeartbeatSent   int
 }
@@ -99,11 +101,11 @@ func (p *Peer) String() string {
 // Zero peer's memory state.
 func (p *Peer) Zero() {
 	sliceZero(p.Key[:])
-	sliceZero(p.tag[:])
-	sliceZero(p.keyAuth[:])
 	sliceZero(p.buf)
+	sliceZero(p.out)
 	sliceZero(p.frame)
 	sliceZero(p.nonce)
+	sliceZero(p.aeadNonce)
 }
 
 var (
@@ -201,7 +203,17 @@ func cprCycleCalculate(rate int) time.Duration {
 	return time.Second / time.Duration(rate*(1<<10)/MTU)
 }
 
-func newPeer(addr string, conn io.Writer, conf *PeerConf, nonce int, key *[SSize]byte) *Peer {
+// newPeer constructs a Peer out of a negotiated suite. suite is
+// whatever the handshake agreed upon via CipherSuiteNegotiate --
+// newPeer itself does no negotiation, it just instantiates the AEAD
+// both sides already settled on. replayWindowBits configures the
+// width of the anti-replay window, supplied by the caller (e.g. read
+// off the peer's configuration); <= 0 falls back to ReplayWindowSize.
+func newPeer(addr string, conn io.Writer, conf *PeerConf, nonce int, key *[SSize]byte, suite CipherSuite, replayWindowBits int) (*Peer, error) {
+	aead, err := NewAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
 	now := time.Now()
 	timeout := conf.Timeout
 	cprCycle := cprCycleCalculate(conf.CPR)
@@ -213,27 +225,43 @@ func newPeer(addr string, conn io.Writer, conf *PeerConf, nonce int, key *[SSize
 		timeout = timeout / TimeoutHeartbeat
 	}
 	peer := Peer{
-		Addr:         addr,
-		Conn:         conn,
-		Timeout:      timeout,
-		Established:  now,
-		LastPing:     now,
-		Id:           conf.Id,
-		NoiseEnable:  noiseEnable,
-		CPR:          conf.CPR,
-		CPRCycle:     cprCycle,
-		NonceOur:     uint64(nonce),
-		NonceRecv:    uint64(0),
-		nonceBucket0: make(map[uint64]struct{}, NonceBucketSize),
-		nonceBucket1: make(map[uint64]struct{}, NonceBucketSize),
-		Key:          key,
-		NonceCipher:  newNonceCipher(key),
-		buf:          make([]byte, MTU+S20BS),
-		tag:          new([poly1305.TagSize]byte),
-		keyAuth:      new([SSize]byte),
-		nonce:        make([]byte, NonceSize),
+		Addr:        addr,
+		Conn:        conn,
+		Timeout:     timeout,
+		Established: now,
+		LastPing:    now,
+		Id:          conf.Id,
+		NoiseEnable: noiseEnable,
+		CPR:         conf.CPR,
+		CPRCycle:    cprCycle,
+		NonceOur:    uint64(nonce),
+		NonceRecv:   uint64(0),
+		replay:      newReplayWindow(replayWindowBits),
+		Cipher:      suite,
+		Key:         key,
+		NonceCipher: newNonceCipher(key),
+		aead:        aead,
+		buf:         make([]byte, MTU+S20BS),
+		out:         make([]byte, 0, NonceSize+MTU+S20BS),
+		nonce:       make([]byte, NonceSize),
+		aeadNonce:   make([]byte, aead.NonceSize()),
+	}
+	return &peer, nil
+}
+
+// NewNegotiatedPeer is the entry point a handshake calls once it
+// knows both sides' offered cipher suites: it settles on a common
+// suite via CipherSuiteNegotiate and builds the Peer around whatever
+// was agreed. It returns ErrUnsupportedCipherSuite when theirSuites
+// has nothing in common with CipherSuitesOffered, so a handshake can
+// reject the peer instead of building one around a suite it does not
+// actually support.
+func NewNegotiatedPeer(addr string, conn io.Writer, conf *PeerConf, nonce int, key *[SSize]byte, theirSuites []CipherSuite, replayWindowBits int) (*Peer, error) {
+	suite, err := CipherSuiteNegotiate(CipherSuitesOffered, theirSuites)
+	if err != nil {
+		return nil, err
 	}
-	return &peer
+	return newPeer(addr, conn, conf, nonce, key, suite, replayWindowBits)
 }
 
 // Process incoming UDP packet.
@@ -242,56 +270,50 @@ func newPeer(addr string, conn io.Writer, conf *PeerConf, nonce int, key *[SSize
 // will be written to the interface immediately (except heartbeat ones).
 func (p *Peer) PktProcess(data []byte, tap io.Writer, ready chan struct{}) bool {
 	p.size = len(data)
-	copy(p.buf, Emptiness)
-	copy(p.tag[:], data[p.size-poly1305.TagSize:])
-	copy(p.buf[S20BS:], data[NonceSize:p.size-poly1305.TagSize])
-	salsa20.XORKeyStream(
-		p.buf[:S20BS+p.size-poly1305.TagSize],
-		p.buf[:S20BS+p.size-poly1305.TagSize],
-		data[:NonceSize],
-		p.Key,
-	)
-	copy(p.keyAuth[:], p.buf[:SSize])
-	if !poly1305.Verify(p.tag, data[:p.size-poly1305.TagSize], p.keyAuth) {
+	if p.size < NonceSize+PktSizeSize+p.aead.Overhead() {
 		ready <- struct{}{}
 		p.FramesUnauth++
 		return false
 	}
-
-	// Check if received nonce is known to us in either of two buckets.
-	// If yes, then this is ignored duplicate.
-	// Check from the oldest bucket, as in most cases this will result
-	// in constant time check.
-	// If Bucket0 is filled, then it becomes Bucket1.
-	p.NonceCipher.Decrypt(p.buf, data[:NonceSize])
-	ready <- struct{}{}
-	p.nonceRecv, _ = binary.Uvarint(p.buf[:NonceSize])
-	if _, p.nonceFound = p.nonceBucket1[p.NonceRecv]; p.nonceFound {
-		p.FramesDup++
+	// The wire nonce is the xtea-obfuscated counter. It is fed to
+	// the AEAD directly as its nonce, zero-padded on the right for
+	// suites (e.g. ChaCha20-Poly1305) whose nonce is wider than
+	// NonceSize.
+	copy(p.aeadNonce, Emptiness)
+	copy(p.aeadNonce, data[:NonceSize])
+	plaintext, err := p.aead.Open(p.buf[:0], p.aeadNonce, data[NonceSize:], nil)
+	if err != nil {
+		ready <- struct{}{}
+		p.FramesUnauth++
 		return false
 	}
-	if _, p.nonceFound = p.nonceBucket0[p.NonceRecv]; p.nonceFound {
-		p.FramesDup++
+
+	// Check received nonce against the sliding replay window: too
+	// far below it is a stale/injected packet, already-set bit is a
+	// duplicate, otherwise it is new and gets recorded.
+	p.NonceCipher.Decrypt(p.nonce, data[:NonceSize])
+	ready <- struct{}{}
+	p.nonceRecv, _ = binary.Uvarint(p.nonce)
+	accepted, tooOld := p.replay.Accept(p.nonceRecv)
+	if !accepted {
+		if tooOld {
+			p.FramesTooOld++
+		} else {
+			p.FramesDup++
+		}
 		return false
 	}
-	p.nonceBucket0[p.NonceRecv] = struct{}{}
-	p.nonceBucketN++
-	if p.nonceBucketN == NonceBucketSize {
-		p.nonceBucket1 = p.nonceBucket0
-		p.nonceBucket0 = make(map[uint64]struct{}, NonceBucketSize)
-		p.nonceBucketN = 0
-	}
 
 	p.FramesIn++
 	p.BytesIn += int64(p.size)
 	p.LastPing = time.Now()
 	p.NonceRecv = p.nonceRecv
-	p.pktSize, _ = binary.Uvarint(p.buf[S20BS : S20BS+PktSizeSize])
+	p.pktSize, _ = binary.Uvarint(plaintext[:PktSizeSize])
 	if p.pktSize == 0 {
 		p.HeartbeatRecv++
 		return true
 	}
-	p.frame = p.buf[S20BS+PktSizeSize : S20BS+PktSizeSize+p.pktSize]
+	p.frame = plaintext[PktSizeSize : PktSizeSize+p.pktSize]
 	p.BytesPayloadIn += int64(p.pktSize)
 	tap.Write(p.frame)
 	return true
@@ -310,9 +332,9 @@ func (p *Peer) EthProcess(data []byte, ready chan struct{}) {
 	}
 	copy(p.buf, Emptiness)
 	if p.size > 0 {
-		copy(p.buf[S20BS+PktSizeSize:], data)
+		copy(p.buf[PktSizeSize:], data)
 		ready <- struct{}{}
-		binary.PutUvarint(p.buf[S20BS:S20BS+PktSizeSize], uint64(p.size))
+		binary.PutUvarint(p.buf[:PktSizeSize], uint64(p.size))
 		p.BytesPayloadOut += int64(p.size)
 	} else {
 		p.HeartbeatSent++
@@ -322,18 +344,18 @@ func (p *Peer) EthProcess(data []byte, ready chan struct{}) {
 	copy(p.nonce, Emptiness)
 	binary.PutUvarint(p.nonce, p.NonceOur)
 	p.NonceCipher.Encrypt(p.nonce, p.nonce)
+	copy(p.aeadNonce, Emptiness)
+	copy(p.aeadNonce, p.nonce)
 
-	salsa20.XORKeyStream(p.buf, p.buf, p.nonce, p.Key)
-	copy(p.buf[S20BS-NonceSize:S20BS], p.nonce)
-	copy(p.keyAuth[:], p.buf[:SSize])
+	var plaintextLen int
 	if p.NoiseEnable {
-		p.frame = p.buf[S20BS-NonceSize : S20BS+MTU-NonceSize-poly1305.TagSize]
+		plaintextLen = MTU - NonceSize - p.aead.Overhead()
 	} else {
-		p.frame = p.buf[S20BS-NonceSize : S20BS+PktSizeSize+p.size]
+		plaintextLen = PktSizeSize + p.size
 	}
-	poly1305.Sum(p.tag, p.frame, p.keyAuth)
+	p.frame = p.aead.Seal(append(p.out[:0], p.nonce...), p.aeadNonce, p.buf[:plaintextLen], nil)
 
-	p.BytesOut += int64(len(p.frame) + poly1305.TagSize)
+	p.BytesOut += int64(len(p.frame))
 	p.FramesOut++
 
 	if p.CPRCycle != time.Duration(0) {
@@ -344,5 +366,5 @@ func (p *Peer) EthProcess(data []byte, ready chan struct{}) {
 		}
 	}
 	p.LastSent = p.now
-	p.Conn.Write(append(p.frame, p.tag[:]...))
+	p.Conn.Write(p.frame)
 }
@@ -0,0 +1,71 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2015 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"io"
+	"testing"
+)
+
+// TestRekeyIfDueEvictsWhenNoConfig drives Listener.rekeyIfDue on a
+// client whose Peer has crossed MaxBytesPerKey, checking that the
+// Peer is zeroed and cleared and, when ConfByID can no longer find a
+// configuration for it, that the client is dropped from the map
+// entirely rather than left behind with a nil Peer.
+func TestRekeyIfDueEvictsWhenNoConfig(t *testing.T) {
+	l := &Listener{
+		ConfByID: func(id *PeerId) *PeerConf { return nil },
+		clients:  make(map[string]*listenerClient),
+	}
+	peer := &Peer{
+		BytesIn:   MaxBytesPerKey,
+		BytesOut:  1,
+		Key:       testKey(1),
+		buf:       make([]byte, 0),
+		out:       make([]byte, 0),
+		frame:     make([]byte, 0),
+		nonce:     make([]byte, 0),
+		aeadNonce: make([]byte, 0),
+	}
+	c := &listenerClient{addr: "127.0.0.1:1", peer: peer, inbox: make(chan []byte, 1), done: make(chan struct{})}
+	l.clients[c.addr] = c
+
+	l.rekeyIfDue(c)
+
+	if c.peer != nil {
+		t.Fatal("peer not cleared once MaxBytesPerKey was exceeded")
+	}
+	if *peer.Key != [SSize]byte{} {
+		t.Fatal("peer key not zeroed once MaxBytesPerKey was exceeded")
+	}
+	if _, exists := l.clients[c.addr]; exists {
+		t.Fatal("client not evicted once ConfByID returned nil for it")
+	}
+}
+
+// TestNewNegotiatedPeerRejectsUnsupportedSuite exercises
+// NewNegotiatedPeer's rejection path: CipherSuiteNegotiate fails
+// before conf is ever dereferenced, so a nil conf is safe to pass
+// here without needing a real PeerConf.
+func TestNewNegotiatedPeerRejectsUnsupportedSuite(t *testing.T) {
+	_, err := NewNegotiatedPeer("peer", io.Discard, nil, 0, testKey(1), []CipherSuite{CipherSuite(99)}, 0)
+	if err != ErrUnsupportedCipherSuite {
+		t.Fatalf("got %v, want ErrUnsupportedCipherSuite", err)
+	}
+}